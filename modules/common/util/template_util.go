@@ -18,16 +18,25 @@ package util
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"fmt"
+	htmltemplate "html/template"
 	"io/ioutil"
 	"os"
 	"path"
 	"path/filepath"
 	"runtime"
+	"strconv"
 	"strings"
-	"text/template"
+	"sync"
+	texttemplate "text/template"
+	"time"
 
+	"github.com/jba/templatecheck"
 	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/yaml"
 )
 
 // TType - TemplateType
@@ -58,6 +67,54 @@ type Template struct {
 	ConfigOptions      map[string]interface{}
 	SkipSetOwner       bool // skip setting ownership on the associated configmap
 	Version            string
+	// CustomFuncs are merged into the FuncMap used to render this Template's
+	// files, taking precedence over funcs registered via RegisterFuncs and
+	// over the package's built-in funcs.
+	CustomFuncs map[string]interface{}
+	// SchemaType is the default schema for ValidateTemplates/
+	// MustValidateTemplates when their schema argument is nil.
+	SchemaType interface{}
+	// ForceEngine overrides the engine EngineFor would otherwise pick for a
+	// file, keyed by filename (e.g. "horizon.html.conf") or by extension
+	// (e.g. ".conf"). Values are EngineText or EngineHTML.
+	ForceEngine map[string]string
+	// Partials lists extra directories of shared snippets to parse into
+	// every file rendered for this Template, in addition to the
+	// conventional <templatesPath>/common/partials and
+	// <templatesPath>/<InstanceType>/partials.
+	Partials []string
+}
+
+// Engine names selecting which of text/template or html/template renders a
+// given file.
+const (
+	// EngineText renders through text/template: no output escaping.
+	EngineText = "text"
+	// EngineHTML renders through html/template: output is escaped for
+	// the HTML/XML context it was written to.
+	EngineHTML = "html"
+)
+
+// defaultEngineFor returns the engine built in for filename's extension.
+func defaultEngineFor(filename string) string {
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".html", ".htm", ".xml", ".svg":
+		return EngineHTML
+	default:
+		return EngineText
+	}
+}
+
+// EngineFor returns the engine to render filename with, honoring
+// forceEngine overrides before falling back to defaultEngineFor.
+func EngineFor(filename string, forceEngine map[string]string) string {
+	if engine, ok := forceEngine[filepath.Base(filename)]; ok {
+		return engine
+	}
+	if engine, ok := forceEngine[filepath.Ext(filename)]; ok {
+		return engine
+	}
+	return defaultEngineFor(filename)
 }
 
 // GetTemplatesPath get path to templates, either running local or deployed as container
@@ -110,56 +167,482 @@ func GetAllTemplates(path string, kind string, templateType string, version stri
 // ExecuteTemplate creates a template from the file and
 // execute it with the specified data
 func ExecuteTemplate(templateFile string, data interface{}) (string, error) {
+	return executeTemplateFile(templateFile, data, templateOptions{cacheable: true})
+}
+
+// template function to increment an int
+func add(x, y int) int {
+	return x + y
+}
+
+// template function to lower a string
+func lower(s string) string {
+	return strings.ToLower(s)
+}
+
+// template function to upper-case a string
+func upper(s string) string {
+	return strings.ToUpper(s)
+}
+
+// template function to title-case a string
+func title(s string) string {
+	return strings.Title(s) //nolint:staticcheck
+}
+
+// template function to trim surrounding whitespace from a string
+func trim(s string) string {
+	return strings.TrimSpace(s)
+}
+
+// template function to replace all occurrences of old with new in s,
+// e.g. {{ "I Am Henry VIII" | replace " " "-" }}
+func replace(old, new, s string) string {
+	return strings.ReplaceAll(s, old, new)
+}
+
+// template function to split s on sep into a slice of strings
+func split(sep, s string) []string {
+	return strings.Split(s, sep)
+}
 
-	b, err := ioutil.ReadFile(templateFile)
+// template function to join a slice of strings with sep
+func join(sep string, items []string) string {
+	return strings.Join(items, sep)
+}
+
+// template function returning def when val is nil or an empty string,
+// e.g. {{ .Foo | default "bar" }}
+func defaultFunc(def, val interface{}) interface{} {
+	if val == nil {
+		return def
+	}
+	if s, ok := val.(string); ok && s == "" {
+		return def
+	}
+	return val
+}
+
+// template function to produce a Go-quoted string
+func quote(s string) string {
+	return strconv.Quote(s)
+}
+
+// template function to indent every line of s by the given number of spaces
+func indent(spaces int, s string) string {
+	pad := strings.Repeat(" ", spaces)
+	lines := strings.Split(s, "\n")
+	for i, line := range lines {
+		lines[i] = pad + line
+	}
+	return strings.Join(lines, "\n")
+}
+
+// template function to render a value as a YAML document
+func toYaml(v interface{}) (string, error) {
+	b, err := yaml.Marshal(v)
 	if err != nil {
 		return "", err
 	}
-	file := string(b)
+	return strings.TrimSuffix(string(b), "\n"), nil
+}
 
-	renderedTemplate, err := ExecuteTemplateData(file, data)
+// template function to base64 encode a string
+func b64enc(s string) string {
+	return base64.StdEncoding.EncodeToString([]byte(s))
+}
+
+// template function to base64 decode a string
+func b64dec(s string) (string, error) {
+	b, err := base64.StdEncoding.DecodeString(s)
 	if err != nil {
 		return "", err
 	}
-	return renderedTemplate, nil
+	return string(b), nil
 }
 
-// template function to increment an int
-func add(x, y int) int {
-	return x + y
+// template function to compute the hex sha256sum of a string
+func sha256sum(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
 }
 
-// template function to lower a string
-func lower(s string) string {
-	return strings.ToLower(s)
+// builtinFuncs are registered for every template rendered by this package,
+// covering the operations OpenStack config templates tend to reimplement.
+var builtinFuncs = texttemplate.FuncMap{
+	"add":       add,
+	"lower":     lower,
+	"upper":     upper,
+	"title":     title,
+	"trim":      trim,
+	"replace":   replace,
+	"split":     split,
+	"join":      join,
+	"default":   defaultFunc,
+	"quote":     quote,
+	"indent":    indent,
+	"toYaml":    toYaml,
+	"b64enc":    b64enc,
+	"b64dec":    b64dec,
+	"sha256sum": sha256sum,
 }
 
-// ExecuteTemplateData creates a template from string and
-// execute it with the specified data
-func ExecuteTemplateData(templateData string, data interface{}) (string, error) {
+var (
+	registeredFuncsMu sync.RWMutex
+	registeredFuncs   = texttemplate.FuncMap{}
+)
 
+// RegisterFuncs adds fn under name to the FuncMap used by every template
+// rendered through this package, so operators can share helpers across
+// controllers without forking lib-common. A name already present in the
+// built-in FuncMap is overridden; a Template's own CustomFuncs take
+// precedence over funcs registered here.
+func RegisterFuncs(name string, fn interface{}) {
+	registeredFuncsMu.Lock()
+	defer registeredFuncsMu.Unlock()
+	registeredFuncs[name] = fn
+
+	// drop templates parsed with the previous FuncMap
+	defaultEngine.mu.Lock()
+	defaultEngine.cache = map[string]*cachedTemplate{}
+	defaultEngine.mu.Unlock()
+}
+
+// funcMap returns the FuncMap a template is parsed with: built-ins, overridden by
+// funcs registered via RegisterFuncs, overridden by extra (typically a
+// Template's CustomFuncs).
+func funcMap(extra map[string]interface{}) texttemplate.FuncMap {
+	funcs := make(texttemplate.FuncMap, len(builtinFuncs)+len(registeredFuncs)+len(extra))
+	for name, fn := range builtinFuncs {
+		funcs[name] = fn
+	}
+
+	registeredFuncsMu.RLock()
+	for name, fn := range registeredFuncs {
+		funcs[name] = fn
+	}
+	registeredFuncsMu.RUnlock()
+
+	for name, fn := range extra {
+		funcs[name] = fn
+	}
+
+	return funcs
+}
+
+// templateOptions - per-Template knobs threaded from GetTemplateData/
+// ValidateTemplates down to the parser.
+type templateOptions struct {
+	// funcs are a Template's CustomFuncs.
+	funcs map[string]interface{}
+	// forceEngine is a Template's ForceEngine.
+	forceEngine map[string]string
+	// templatesPath is the templates base path the conventional partial
+	// directories are found under, and extraPartials is a Template's
+	// Partials; both are left unresolved until parse time.
+	templatesPath string
+	extraPartials []string
+	// cacheKind is the Template's InstanceType.
+	cacheKind string
+	// cacheable is true when a Template's CustomFuncs is empty.
+	cacheable bool
+}
+
+// resolvedPartials globs opts' conventional and extra partial directories.
+func (opts templateOptions) resolvedPartials() ([]string, error) {
+	if opts.templatesPath == "" {
+		return nil, nil
+	}
+	return partialFiles(opts.templatesPath, opts.cacheKind, opts.extraPartials)
+}
+
+// partialDirs - directories searched for partials: common, kind-specific,
+// then extra.
+func partialDirs(templatesPath, kind string, extra []string) []string {
+	dirs := []string{
+		fmt.Sprintf("%s/common/partials", templatesPath),
+		fmt.Sprintf("%s/%s/partials", templatesPath, strings.ToLower(kind)),
+	}
+	return append(dirs, extra...)
+}
+
+// partialFiles globs the files in partialDirs, erroring on a name collision
+// across directories.
+func partialFiles(templatesPath, kind string, extra []string) ([]string, error) {
+	var files []string
+	seenAt := map[string]string{}
+	for _, dir := range partialDirs(templatesPath, kind, extra) {
+		matches, err := filepath.Glob(dir + "/*")
+		if err != nil {
+			continue
+		}
+		for _, m := range matches {
+			if strings.HasPrefix(filepath.Base(m), ".") {
+				continue
+			}
+			if fi, err := os.Stat(m); err != nil || fi.Mode().IsDir() {
+				continue
+			}
+			name := partialName(m)
+			if prev, ok := seenAt[name]; ok {
+				return nil, fmt.Errorf("partial %q defined in both %s and %s", name, prev, m)
+			}
+			seenAt[name] = m
+			files = append(files, m)
+		}
+	}
+	return files, nil
+}
+
+// partialName is the name a partial file is made available under in a
+// template set: its base filename with the extension stripped.
+func partialName(file string) string {
+	base := filepath.Base(file)
+	return strings.TrimSuffix(base, filepath.Ext(base))
+}
+
+// parsedTemplate wraps whichever engine actually parsed a file.
+type parsedTemplate struct {
+	text *texttemplate.Template
+	html *htmltemplate.Template
+}
+
+// parseTemplate parses body under name with the engine EngineFor selects,
+// parsing partials into the same template set under partialName.
+func parseTemplate(name, body string, opts templateOptions, partials []string) (*parsedTemplate, error) {
+	funcs := funcMap(opts.funcs)
+	base := filepath.Base(name)
+
+	if EngineFor(name, opts.forceEngine) == EngineHTML {
+		tmpl, err := htmltemplate.New(base).Funcs(htmltemplate.FuncMap(funcs)).Parse(body)
+		if err != nil {
+			return nil, err
+		}
+		for _, partial := range partials {
+			b, err := ioutil.ReadFile(partial)
+			if err != nil {
+				return nil, err
+			}
+			if _, err := tmpl.New(partialName(partial)).Parse(string(b)); err != nil {
+				return nil, fmt.Errorf("parsing partial %s: %w", partial, err)
+			}
+		}
+		return &parsedTemplate{html: tmpl}, nil
+	}
+
+	tmpl, err := texttemplate.New(base).Funcs(texttemplate.FuncMap(funcs)).Parse(body)
+	if err != nil {
+		return nil, err
+	}
+	for _, partial := range partials {
+		b, err := ioutil.ReadFile(partial)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := tmpl.New(partialName(partial)).Parse(string(b)); err != nil {
+			return nil, fmt.Errorf("parsing partial %s: %w", partial, err)
+		}
+	}
+	return &parsedTemplate{text: tmpl}, nil
+}
+
+// Execute renders the template with data and returns the output as a string.
+func (p *parsedTemplate) Execute(data interface{}) (string, error) {
 	var buff bytes.Buffer
-	funcs := template.FuncMap{
-		"add":   add,
-		"lower": lower,
+
+	var err error
+	if p.html != nil {
+		err = p.html.Execute(&buff, data)
+	} else {
+		err = p.text.Execute(&buff, data)
 	}
-	tmpl, err := template.New("tmp").Funcs(funcs).Parse(templateData)
 	if err != nil {
 		return "", err
 	}
-	err = tmpl.Execute(&buff, data)
+
+	return buff.String(), nil
+}
+
+// cachedPartial is a partial file baked into a cachedTemplate, with the
+// mtime it had when parsed.
+type cachedPartial struct {
+	path    string
+	modTime time.Time
+}
+
+// cachedPartialDir is a partial directory searched for a cachedTemplate,
+// with the mtime it had when parsed.
+type cachedPartialDir struct {
+	path    string
+	modTime time.Time
+}
+
+// cachedTemplate is a parsed template with the mtimes it was parsed at.
+type cachedTemplate struct {
+	tmpl        *parsedTemplate
+	modTime     time.Time
+	partials    []cachedPartial
+	partialDirs []cachedPartialDir
+}
+
+// TemplateEngine lazily parses and caches the parsed template for every
+// file this package renders, keyed by its path on disk together with the
+// partial kind/dirs and the engine it was parsed with (see cacheKey).
+type TemplateEngine struct {
+	mu    sync.RWMutex
+	cache map[string]*cachedTemplate
+}
+
+// defaultEngine backs every file-based render in this package.
+var defaultEngine = &TemplateEngine{cache: map[string]*cachedTemplate{}}
+
+// parse returns a cached *parsedTemplate for path, reparsing when the mtime
+// of the file, one of its partials or a partial directory moves on. With
+// OPERATOR_TEMPLATES set, a cached entry is served without any mtime check.
+// Calls with opts.cacheable false bypass the cache.
+func (e *TemplateEngine) parse(path string, opts templateOptions) (*parsedTemplate, error) {
+	key := cacheKey(path, opts.cacheKind, opts.extraPartials, EngineFor(path, opts.forceEngine))
+
+	if opts.cacheable {
+		if tmpl, ok := e.lookup(key, path); ok {
+			return tmpl, nil
+		}
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	partials, err := opts.resolvedPartials()
+	if err != nil {
+		return nil, err
+	}
+
+	tmpl, err := parseTemplate(path, string(b), opts, partials)
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.cacheable {
+		e.store(key, path, opts, partials, tmpl)
+	}
+
+	return tmpl, nil
+}
+
+// cacheKey identifies a cache entry by file path, partial kind/dirs, and
+// the engine it was parsed with.
+func cacheKey(path, kind string, extraPartials []string, engine string) string {
+	return kind + "\x00" + strings.Join(extraPartials, "\x00") + "\x00" + engine + "\x00" + path
+}
+
+func (e *TemplateEngine) lookup(key, path string) (*parsedTemplate, bool) {
+	e.mu.RLock()
+	entry, ok := e.cache[key]
+	e.mu.RUnlock()
+	if !ok {
+		return nil, false
+	}
+
+	if os.Getenv("OPERATOR_TEMPLATES") != "" {
+		return entry.tmpl, true
+	}
+
+	fi, err := os.Stat(path)
+	if err != nil || fi.ModTime().After(entry.modTime) {
+		return nil, false
+	}
+
+	for _, partial := range entry.partials {
+		fi, err := os.Stat(partial.path)
+		if err != nil || fi.ModTime().After(partial.modTime) {
+			return nil, false
+		}
+	}
+
+	for _, dir := range entry.partialDirs {
+		if partialDirChanged(dir.path, dir.modTime) {
+			return nil, false
+		}
+	}
+
+	return entry.tmpl, true
+}
+
+// partialDirChanged reports whether dir's mtime moved on since recorded.
+func partialDirChanged(dir string, recorded time.Time) bool {
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return !recorded.IsZero()
+	}
+	return recorded.IsZero() || fi.ModTime().After(recorded)
+}
+
+func (e *TemplateEngine) store(key, path string, opts templateOptions, partials []string, tmpl *parsedTemplate) {
+	var modTime time.Time
+	if fi, err := os.Stat(path); err == nil {
+		modTime = fi.ModTime()
+	}
+
+	cachedPartials := make([]cachedPartial, 0, len(partials))
+	for _, partial := range partials {
+		var partialModTime time.Time
+		if fi, err := os.Stat(partial); err == nil {
+			partialModTime = fi.ModTime()
+		}
+		cachedPartials = append(cachedPartials, cachedPartial{path: partial, modTime: partialModTime})
+	}
+
+	var cachedDirs []cachedPartialDir
+	if opts.templatesPath != "" {
+		dirs := partialDirs(opts.templatesPath, opts.cacheKind, opts.extraPartials)
+		cachedDirs = make([]cachedPartialDir, 0, len(dirs))
+		for _, dir := range dirs {
+			var dirModTime time.Time
+			if fi, err := os.Stat(dir); err == nil {
+				dirModTime = fi.ModTime()
+			}
+			cachedDirs = append(cachedDirs, cachedPartialDir{path: dir, modTime: dirModTime})
+		}
+	}
+
+	e.mu.Lock()
+	e.cache[key] = &cachedTemplate{tmpl: tmpl, modTime: modTime, partials: cachedPartials, partialDirs: cachedDirs}
+	e.mu.Unlock()
+}
+
+// ExecuteTemplateData creates a template from string and
+// execute it with the specified data
+func ExecuteTemplateData(templateData string, data interface{}) (string, error) {
+	return executeTemplateData(templateData, data, nil)
+}
+
+func executeTemplateData(templateData string, data interface{}, extra map[string]interface{}) (string, error) {
+	tmpl, err := texttemplate.New("tmp").Funcs(funcMap(extra)).Parse(templateData)
 	if err != nil {
 		return "", err
 	}
+	var buff bytes.Buffer
+	if err := tmpl.Execute(&buff, data); err != nil {
+		return "", err
+	}
 	return buff.String(), nil
 }
 
+func executeTemplateFile(templateFile string, data interface{}, opts templateOptions) (string, error) {
+	tmpl, err := defaultEngine.parse(templateFile, opts)
+	if err != nil {
+		return "", err
+	}
+	return tmpl.Execute(data)
+}
+
 // ExecuteTemplateFile creates a template from the file and
 // execute it with the specified data
 // Note: mschuppert - can be removed when all operators switched
 //       to the above ones.
 func ExecuteTemplateFile(filename string, data interface{}) (string, error) {
-
 	templates := os.Getenv("OPERATOR_TEMPLATES")
 	filepath := ""
 	if templates == "" {
@@ -171,33 +654,60 @@ func ExecuteTemplateFile(filename string, data interface{}) (string, error) {
 		filepath = path.Join(templates + filename)
 	}
 
-	b, err := ioutil.ReadFile(filepath)
-	if err != nil {
-		return "", err
-	}
-	file := string(b)
-	var buff bytes.Buffer
-	funcs := template.FuncMap{
-		"add":   add,
-		"lower": lower,
+	return executeTemplateFile(filepath, data, templateOptions{cacheable: true})
+}
+
+// executeAdditionalTemplateFile resolves filename exactly like
+// ExecuteTemplateFile, for use by GetTemplateData so AdditionalTemplate
+// entries honor a Template's CustomFuncs, ForceEngine and Partials too.
+func executeAdditionalTemplateFile(filename string, data interface{}, opts templateOptions) (string, error) {
+	templates := os.Getenv("OPERATOR_TEMPLATES")
+	filepath := ""
+	if templates == "" {
+		// support local testing with 'up local'
+		_, basefile, _, _ := runtime.Caller(1)
+		filepath = path.Join(path.Dir(basefile), "../../templates/"+filename)
+	} else {
+		// deployed as a container
+		filepath = path.Join(templates + filename)
 	}
-	tmpl, err := template.New("tmp").Funcs(funcs).Parse(file)
-	if err != nil {
-		return "", err
+
+	return executeTemplateFile(filepath, data, opts)
+}
+
+// resolveAdditionalTemplatePath resolves filename exactly like
+// ExecuteTemplateFile, for callers that need the path without rendering it.
+func resolveAdditionalTemplatePath(filename string) string {
+	templates := os.Getenv("OPERATOR_TEMPLATES")
+	if templates == "" {
+		// support local testing with 'up local'
+		_, basefile, _, _ := runtime.Caller(1)
+		return path.Join(path.Dir(basefile), "../../templates/"+filename)
 	}
-	err = tmpl.Execute(&buff, data)
-	if err != nil {
-		return "", err
+	// deployed as a container
+	return path.Join(templates + filename)
+}
+
+// templateOptionsFor builds the templateOptions shared by every file
+// GetTemplateData/ValidateTemplates render or validate for t.
+func templateOptionsFor(t Template, templatesPath string) templateOptions {
+	return templateOptions{
+		funcs:         t.CustomFuncs,
+		forceEngine:   t.ForceEngine,
+		templatesPath: templatesPath,
+		extraPartials: t.Partials,
+		cacheKind:     t.InstanceType,
+		cacheable:     len(t.CustomFuncs) == 0,
 	}
-	return buff.String(), nil
 }
 
 // GetTemplateData -
 func GetTemplateData(t Template) (map[string]string, error) {
-	opts := t.ConfigOptions
+	configOpts := t.ConfigOptions
 
 	// get templates base path, either running local or deployed as container
 	templatesPath := GetTemplatesPath()
+	renderOpts := templateOptionsFor(t, templatesPath)
 
 	data := make(map[string]string)
 
@@ -207,7 +717,7 @@ func GetTemplateData(t Template) (map[string]string, error) {
 
 		// render all template files
 		for _, file := range templatesFiles {
-			renderedData, err := ExecuteTemplate(file, opts)
+			renderedData, err := executeTemplateFile(file, configOpts, renderOpts)
 			if err != nil {
 				return data, err
 			}
@@ -217,7 +727,7 @@ func GetTemplateData(t Template) (map[string]string, error) {
 	// add additional template files from different directory, which
 	// e.g. can be common to multiple controllers
 	for filename, file := range t.AdditionalTemplate {
-		renderedTemplate, err := ExecuteTemplateFile(file, opts)
+		renderedTemplate, err := executeAdditionalTemplateFile(file, configOpts, renderOpts)
 		if err != nil {
 			return nil, err
 		}
@@ -226,3 +736,67 @@ func GetTemplateData(t Template) (map[string]string, error) {
 
 	return data, nil
 }
+
+// ValidateTemplates runs templatecheck against schema (or t.SchemaType if
+// schema is nil) for every template GetTemplateData would render for t.
+func ValidateTemplates(t Template, schema interface{}) error {
+	if schema == nil {
+		schema = t.SchemaType
+	}
+
+	templatesPath := GetTemplatesPath()
+	renderOpts := templateOptionsFor(t, templatesPath)
+	partials, err := renderOpts.resolvedPartials()
+	if err != nil {
+		return err
+	}
+
+	if t.Type != TemplateTypeNone {
+		templatesFiles := GetAllTemplates(templatesPath, t.InstanceType, string(t.Type), string(t.Version))
+
+		for _, file := range templatesFiles {
+			if err := validateTemplateFile(file, renderOpts, partials, schema); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, file := range t.AdditionalTemplate {
+		if err := validateTemplateFile(resolveAdditionalTemplatePath(file), renderOpts, partials, schema); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// MustValidateTemplates is ValidateTemplates for use at operator startup:
+// it panics instead of returning an error.
+func MustValidateTemplates(t Template, schema interface{}) {
+	if err := ValidateTemplates(t, schema); err != nil {
+		panic(err)
+	}
+}
+
+func validateTemplateFile(path string, opts templateOptions, partials []string, schema interface{}) error {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	tmpl, err := parseTemplate(path, string(b), opts, partials)
+	if err != nil {
+		return fmt.Errorf("parsing template %s: %w", path, err)
+	}
+
+	if tmpl.html != nil {
+		err = templatecheck.CheckHTML(tmpl.html, schema)
+	} else {
+		err = templatecheck.CheckText(tmpl.text, schema)
+	}
+	if err != nil {
+		return fmt.Errorf("validating template %s: %w", path, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,528 @@
+/*
+Copyright 2022 Red Hat
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	texttemplate "text/template"
+	"time"
+)
+
+// TestFuncMapPrecedence verifies CustomFuncs override RegisterFuncs, which
+// override the package's built-in funcs.
+func TestFuncMapPrecedence(t *testing.T) {
+	builtin := funcMap(nil)["lower"].(func(string) string)
+	if got := builtin("ABC"); got != "abc" {
+		t.Fatalf("builtin lower(\"ABC\") = %q, want %q", got, "abc")
+	}
+
+	RegisterFuncs("lower", func(string) string { return "registered" })
+	defer func() {
+		registeredFuncsMu.Lock()
+		delete(registeredFuncs, "lower")
+		registeredFuncsMu.Unlock()
+	}()
+
+	registered := funcMap(nil)["lower"].(func(string) string)
+	if got := registered("ABC"); got != "registered" {
+		t.Fatalf("registered lower(\"ABC\") = %q, want %q", got, "registered")
+	}
+
+	custom := funcMap(map[string]interface{}{
+		"lower": func(string) string { return "custom" },
+	})["lower"].(func(string) string)
+	if got := custom("ABC"); got != "custom" {
+		t.Fatalf("custom lower(\"ABC\") = %q, want %q", got, "custom")
+	}
+}
+
+// TestExecuteTemplateFuncMapParity verifies ExecuteTemplate,
+// ExecuteTemplateData and ExecuteTemplateFile all render against the same
+// FuncMap, including a func added via RegisterFuncs.
+func TestExecuteTemplateFuncMapParity(t *testing.T) {
+	RegisterFuncs("shout", func(s string) string { return s + "!" })
+	defer func() {
+		registeredFuncsMu.Lock()
+		delete(registeredFuncs, "shout")
+		registeredFuncsMu.Unlock()
+	}()
+
+	const body = "{{ . | upper | shout }}"
+	const want = "HI!"
+
+	dir := t.TempDir()
+	file := filepath.Join(dir, "greeting.txt")
+	if err := os.WriteFile(file, []byte(body), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := ExecuteTemplate(file, "hi")
+	if err != nil {
+		t.Fatalf("ExecuteTemplate: %v", err)
+	}
+	if got != want {
+		t.Fatalf("ExecuteTemplate = %q, want %q", got, want)
+	}
+
+	got, err = ExecuteTemplateData(body, "hi")
+	if err != nil {
+		t.Fatalf("ExecuteTemplateData: %v", err)
+	}
+	if got != want {
+		t.Fatalf("ExecuteTemplateData = %q, want %q", got, want)
+	}
+
+	t.Setenv("OPERATOR_TEMPLATES", dir)
+	got, err = ExecuteTemplateFile("/greeting.txt", "hi")
+	if err != nil {
+		t.Fatalf("ExecuteTemplateFile: %v", err)
+	}
+	if got != want {
+		t.Fatalf("ExecuteTemplateFile = %q, want %q", got, want)
+	}
+}
+
+// TestTemplateEngineCacheInvalidation verifies an edited file is re-parsed
+// on the next call once its mtime moves on.
+func TestTemplateEngineCacheInvalidation(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "greeting.txt")
+	if err := os.WriteFile(file, []byte("v1:{{.}}"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	engine := &TemplateEngine{cache: map[string]*cachedTemplate{}}
+	opts := templateOptions{cacheable: true}
+
+	tmpl, err := engine.parse(file, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := tmpl.Execute("x"); got != "v1:x" {
+		t.Fatalf("first parse = %q, want %q", got, "v1:x")
+	}
+
+	future := time.Now().Add(time.Minute)
+	if err := os.WriteFile(file, []byte("v2:{{.}}"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(file, future, future); err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl, err = engine.parse(file, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := tmpl.Execute("x"); got != "v2:x" {
+		t.Fatalf("parse after edit = %q, want %q", got, "v2:x")
+	}
+}
+
+// TestTemplateEngineContainerModeSkipsInvalidation verifies that with
+// OPERATOR_TEMPLATES set, a cached entry is served even after its file
+// changes on disk.
+func TestTemplateEngineContainerModeSkipsInvalidation(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "greeting.txt")
+	if err := os.WriteFile(file, []byte("v1:{{.}}"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("OPERATOR_TEMPLATES", dir)
+
+	engine := &TemplateEngine{cache: map[string]*cachedTemplate{}}
+	opts := templateOptions{cacheable: true}
+
+	if _, err := engine.parse(file, opts); err != nil {
+		t.Fatal(err)
+	}
+
+	future := time.Now().Add(time.Minute)
+	if err := os.WriteFile(file, []byte("v2:{{.}}"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(file, future, future); err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl, err := engine.parse(file, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := tmpl.Execute("x"); got != "v1:x" {
+		t.Fatalf("container-mode parse = %q, want cached %q", got, "v1:x")
+	}
+}
+
+type benchTemplateData struct {
+	Name string
+	Msg  string
+}
+
+// writeBenchTemplates writes n template files under a fresh temp dir and
+// returns their paths.
+func writeBenchTemplates(b *testing.B, n int) []string {
+	dir := b.TempDir()
+	files := make([]string, n)
+	for i := 0; i < n; i++ {
+		f := filepath.Join(dir, fmt.Sprintf("tmpl-%d.txt", i))
+		body := fmt.Sprintf("template %d: {{ .Name }} says {{ .Msg | upper }}", i)
+		if err := os.WriteFile(f, []byte(body), 0o644); err != nil {
+			b.Fatal(err)
+		}
+		files[i] = f
+	}
+	return files
+}
+
+// BenchmarkRenderWithoutCache re-reads and re-parses every file on every
+// iteration, the way ExecuteTemplate did before the TemplateEngine.
+func BenchmarkRenderWithoutCache(b *testing.B) {
+	files := writeBenchTemplates(b, 50)
+	data := benchTemplateData{Name: "nova", Msg: "hi"}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, f := range files {
+			body, err := ioutil.ReadFile(f)
+			if err != nil {
+				b.Fatal(err)
+			}
+			tmpl, err := texttemplate.New(filepath.Base(f)).Funcs(funcMap(nil)).Parse(string(body))
+			if err != nil {
+				b.Fatal(err)
+			}
+			var buf bytes.Buffer
+			if err := tmpl.Execute(&buf, data); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+// BenchmarkRenderWithEngine renders the same files through one
+// TemplateEngine, which parses each file on the first iteration and serves
+// it from its cache afterwards, so each file is parsed once regardless of b.N.
+func BenchmarkRenderWithEngine(b *testing.B) {
+	files := writeBenchTemplates(b, 50)
+	data := benchTemplateData{Name: "nova", Msg: "hi"}
+	engine := &TemplateEngine{cache: map[string]*cachedTemplate{}}
+	opts := templateOptions{cacheable: true}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, f := range files {
+			tmpl, err := engine.parse(f, opts)
+			if err != nil {
+				b.Fatal(err)
+			}
+			if _, err := tmpl.Execute(data); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+// TestValidateTemplatesReportsUnknownField verifies ValidateTemplates names
+// the offending file and field when a template references a schema field
+// that doesn't exist.
+func TestValidateTemplatesReportsUnknownField(t *testing.T) {
+	dir := t.TempDir()
+	confDir := filepath.Join(dir, "widget", "config")
+	if err := os.MkdirAll(confDir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(confDir, "broken.conf"), []byte("value = {{ .Foo.Bar }}"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("OPERATOR_TEMPLATES", dir)
+
+	type schema struct {
+		Name string
+	}
+
+	err := ValidateTemplates(Template{InstanceType: "widget", Type: TemplateTypeConfig}, schema{})
+	if err == nil {
+		t.Fatal("expected ValidateTemplates to report the unknown .Foo field, got nil")
+	}
+	if !strings.Contains(err.Error(), "broken.conf") {
+		t.Fatalf("error %q does not name the offending file", err.Error())
+	}
+	if !strings.Contains(err.Error(), "Foo") {
+		t.Fatalf("error %q does not name the offending field", err.Error())
+	}
+}
+
+// TestValidateTemplatesAcceptsMatchingSchema verifies a template that only
+// references fields present on schema passes validation.
+func TestValidateTemplatesAcceptsMatchingSchema(t *testing.T) {
+	dir := t.TempDir()
+	confDir := filepath.Join(dir, "widget", "config")
+	if err := os.MkdirAll(confDir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(confDir, "ok.conf"), []byte("value = {{ .Name }}"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("OPERATOR_TEMPLATES", dir)
+
+	type schema struct {
+		Name string
+	}
+
+	if err := ValidateTemplates(Template{InstanceType: "widget", Type: TemplateTypeConfig}, schema{}); err != nil {
+		t.Fatalf("ValidateTemplates on a matching schema: %v", err)
+	}
+}
+
+// TestMustValidateTemplatesPanics verifies MustValidateTemplates panics
+// rather than returning when a template fails validation.
+func TestMustValidateTemplatesPanics(t *testing.T) {
+	dir := t.TempDir()
+	confDir := filepath.Join(dir, "widget", "config")
+	if err := os.MkdirAll(confDir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(confDir, "broken.conf"), []byte("{{ .Foo.Bar }}"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("OPERATOR_TEMPLATES", dir)
+
+	type schema struct {
+		Name string
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Fatal("expected MustValidateTemplates to panic on a packaging bug")
+		}
+	}()
+	MustValidateTemplates(Template{InstanceType: "widget", Type: TemplateTypeConfig}, schema{})
+}
+
+// TestExecuteTemplateEscapesHTML verifies a .html file renders through
+// html/template, escaping a value that would otherwise inject markup.
+func TestExecuteTemplateEscapesHTML(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "page.html")
+	if err := os.WriteFile(file, []byte("<p>{{ . }}</p>"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := ExecuteTemplate(file, "<script>alert(1)</script>")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(got, "<script>") {
+		t.Fatalf("rendered HTML was not escaped: %q", got)
+	}
+	if !strings.Contains(got, "&lt;script&gt;") {
+		t.Fatalf("rendered HTML missing expected escaping: %q", got)
+	}
+}
+
+// TestExecuteTemplateLeavesShellUnescaped verifies a non-markup file (e.g.
+// a shell script) still renders through text/template, with no escaping.
+func TestExecuteTemplateLeavesShellUnescaped(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "script.sh")
+	if err := os.WriteFile(file, []byte("echo '{{ . }}'"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	const value = "<script>alert(1)</script>"
+	got, err := ExecuteTemplate(file, value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "echo '" + value + "'"
+	if got != want {
+		t.Fatalf("ExecuteTemplate = %q, want unescaped %q", got, want)
+	}
+}
+
+// mustWriteFile writes body to path, creating any missing parent directories.
+func mustWriteFile(t *testing.T, path, body string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(body), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestGetTemplateDataComposesPartials verifies a config template can pull
+// in both a shared common partial and a kind-specific partial, rendered
+// with the Template's ConfigOptions.
+func TestGetTemplateDataComposesPartials(t *testing.T) {
+	dir := t.TempDir()
+	mustWriteFile(t, filepath.Join(dir, "common", "partials", "keystone_authtoken.conf"), "auth_url = {{ .AuthURL }}")
+	mustWriteFile(t, filepath.Join(dir, "widget", "partials", "db.conf"), "db_url = {{ .DBURL }}")
+	mustWriteFile(t, filepath.Join(dir, "widget", "config", "app.conf"),
+		"{{ template \"keystone_authtoken\" . }}\n{{ template \"db\" . }}")
+	t.Setenv("OPERATOR_TEMPLATES", dir)
+
+	tmpl := Template{
+		InstanceType: "widget",
+		Type:         TemplateTypeConfig,
+		ConfigOptions: map[string]interface{}{
+			"AuthURL": "https://keystone.example",
+			"DBURL":   "mysql://db.example",
+		},
+	}
+
+	data, err := GetTemplateData(tmpl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := data["app.conf"]
+	if !strings.Contains(got, "auth_url = https://keystone.example") {
+		t.Fatalf("rendered app.conf missing common partial: %q", got)
+	}
+	if !strings.Contains(got, "db_url = mysql://db.example") {
+		t.Fatalf("rendered app.conf missing kind partial: %q", got)
+	}
+}
+
+// TestGetTemplateDataMissingPartialFailsLoudly verifies a template
+// referencing an undefined partial fails instead of rendering empty output.
+func TestGetTemplateDataMissingPartialFailsLoudly(t *testing.T) {
+	dir := t.TempDir()
+	mustWriteFile(t, filepath.Join(dir, "widget", "config", "app.conf"), "{{ template \"does_not_exist\" . }}")
+	t.Setenv("OPERATOR_TEMPLATES", dir)
+
+	_, err := GetTemplateData(Template{InstanceType: "widget", Type: TemplateTypeConfig})
+	if err == nil {
+		t.Fatal("expected GetTemplateData to fail on a missing partial, got nil")
+	}
+}
+
+// TestTemplateEngineDetectsNewPartial verifies a partial file added to a
+// partials directory after the first parse is picked up once the
+// directory's own mtime moves on, without waiting for an edit to a file
+// the engine already knew about.
+func TestTemplateEngineDetectsNewPartial(t *testing.T) {
+	dir := t.TempDir()
+	partialsDir := filepath.Join(dir, "common", "partials")
+	if err := os.MkdirAll(partialsDir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	appFile := filepath.Join(dir, "widget", "config", "app.conf")
+	mustWriteFile(t, appFile, "{{ template \"greeting\" . }}")
+
+	opts := templateOptions{templatesPath: dir, cacheKind: "widget", cacheable: true}
+	engine := &TemplateEngine{cache: map[string]*cachedTemplate{}}
+
+	tmpl, err := engine.parse(appFile, opts)
+	if err != nil {
+		t.Fatalf("unexpected parse error before the partial exists: %v", err)
+	}
+	if _, err := tmpl.Execute(map[string]string{"Name": "nova"}); err == nil {
+		t.Fatal("expected Execute to fail before the partial exists")
+	}
+
+	future := time.Now().Add(time.Minute)
+	if err := os.WriteFile(filepath.Join(partialsDir, "greeting.conf"), []byte("hello {{ .Name }}"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(partialsDir, future, future); err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl, err = engine.parse(appFile, opts)
+	if err != nil {
+		t.Fatalf("parse after adding partial: %v", err)
+	}
+	got, err := tmpl.Execute(map[string]string{"Name": "nova"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "hello nova" {
+		t.Fatalf("got %q, want %q", got, "hello nova")
+	}
+}
+
+// TestTemplateEngineForceEngineNotSharedAcrossCallers verifies that a path
+// first parsed as text/template (no ForceEngine) and then parsed again with
+// a ForceEngine override to html/template gets its own cache entry, rather
+// than the second call reusing the first's unescaped text/template result.
+func TestTemplateEngineForceEngineNotSharedAcrossCallers(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "page.conf")
+	if err := os.WriteFile(file, []byte("<p>{{ . }}</p>"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	engine := &TemplateEngine{cache: map[string]*cachedTemplate{}}
+	const value = "<script>alert(1)</script>"
+
+	textTmpl, err := engine.parse(file, templateOptions{cacheable: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	textGot, err := textTmpl.Execute(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(textGot, "<script>") {
+		t.Fatalf("expected unescaped text/template render, got %q", textGot)
+	}
+
+	htmlTmpl, err := engine.parse(file, templateOptions{
+		cacheable:   true,
+		forceEngine: map[string]string{"page.conf": EngineHTML},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	htmlGot, err := htmlTmpl.Execute(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(htmlGot, "<script>") {
+		t.Fatalf("expected ForceEngine override to escape, got unescaped %q", htmlGot)
+	}
+	if !strings.Contains(htmlGot, "&lt;script&gt;") {
+		t.Fatalf("expected ForceEngine override to escape, got %q", htmlGot)
+	}
+}
+
+// TestGetTemplateDataCollidingPartialNamesFail verifies a partial name
+// present in both common/partials and <kind>/partials errors instead of one
+// directory silently shadowing the other.
+func TestGetTemplateDataCollidingPartialNamesFail(t *testing.T) {
+	dir := t.TempDir()
+	mustWriteFile(t, filepath.Join(dir, "common", "partials", "db.conf"), "db_url = common")
+	mustWriteFile(t, filepath.Join(dir, "widget", "partials", "db.conf"), "db_url = widget")
+	mustWriteFile(t, filepath.Join(dir, "widget", "config", "app.conf"), "{{ template \"db\" . }}")
+	t.Setenv("OPERATOR_TEMPLATES", dir)
+
+	_, err := GetTemplateData(Template{InstanceType: "widget", Type: TemplateTypeConfig})
+	if err == nil {
+		t.Fatal("expected GetTemplateData to error on colliding partial names, got nil")
+	}
+	if !strings.Contains(err.Error(), "db") {
+		t.Fatalf("error %q does not name the colliding partial", err.Error())
+	}
+}